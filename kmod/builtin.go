@@ -0,0 +1,101 @@
+// Copyright 2017 Tristan Claverie. All rights reserved.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package kmod
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// modulesDir is where the kernel's per-release module tree lives absent
+// an explicit WithModuleDir.
+const modulesDir = "/lib/modules"
+
+func unameRelease() (string, error) {
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err != nil {
+		return "", err
+	}
+	return unix.ByteSliceToString(uts.Release[:]), nil
+}
+
+// moduleName derives a module name from a .ko/.ko.gz/.ko.xz/.ko.zst
+// path the way depmod does: take the file name, strip the known
+// suffixes and normalize dashes to underscores.
+func moduleName(path string) string {
+	name := filepath.Base(path)
+	for _, suffix := range []string{".ko.gz", ".ko.xz", ".ko.zst", ".ko"} {
+		if strings.HasSuffix(name, suffix) {
+			name = strings.TrimSuffix(name, suffix)
+			break
+		}
+	}
+	return strings.ReplaceAll(name, "-", "_")
+}
+
+// loadBuiltinNames reads modules.builtin under moduleDir and returns the
+// set of module names compiled into the kernel. A missing file is not
+// an error: plenty of kernels ship without one.
+func loadBuiltinNames(moduleDir string) (map[string]bool, error) {
+	builtin := map[string]bool{}
+
+	f, err := os.Open(filepath.Join(moduleDir, "modules.builtin"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return builtin, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		builtin[moduleName(line)] = true
+	}
+	return builtin, scanner.Err()
+}
+
+// loadBuiltinInfo reads modules.builtin.modinfo under moduleDir: a
+// sequence of NUL-separated "modname.key=value" fields, and groups them
+// by module name. A missing file is not an error.
+func loadBuiltinInfo(moduleDir string) (map[string]map[string]string, error) {
+	info := map[string]map[string]string{}
+
+	data, err := os.ReadFile(filepath.Join(moduleDir, "modules.builtin.modinfo"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return info, nil
+		}
+		return nil, err
+	}
+
+	for _, field := range bytes.Split(data, []byte{0}) {
+		if len(field) == 0 {
+			continue
+		}
+		name, rest, ok := strings.Cut(string(field), ".")
+		if !ok {
+			continue
+		}
+		key, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			continue
+		}
+		if info[name] == nil {
+			info[name] = map[string]string{}
+		}
+		info[name][key] = value
+	}
+	return info, nil
+}
@@ -0,0 +1,87 @@
+// Copyright 2017 Tristan Claverie. All rights reserved.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package kmod
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadBuiltinNames(t *testing.T) {
+	dir := t.TempDir()
+	content := "kernel/drivers/char/pcspkr.ko\nkernel/fs/ext4/ext4.ko\n\n"
+	if err := os.WriteFile(filepath.Join(dir, "modules.builtin"), []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	builtin, err := loadBuiltinNames(dir)
+	if err != nil {
+		t.Fatalf("loadBuiltinNames: %s", err)
+	}
+	want := map[string]bool{"pcspkr": true, "ext4": true}
+	if !reflect.DeepEqual(builtin, want) {
+		t.Errorf("loadBuiltinNames = %v, want %v", builtin, want)
+	}
+}
+
+func TestLoadBuiltinNames_Missing(t *testing.T) {
+	builtin, err := loadBuiltinNames(t.TempDir())
+	if err != nil {
+		t.Fatalf("loadBuiltinNames: want nil error for a missing modules.builtin, got %s", err)
+	}
+	if len(builtin) != 0 {
+		t.Errorf("loadBuiltinNames = %v, want empty", builtin)
+	}
+}
+
+func TestLoadBuiltinInfo(t *testing.T) {
+	dir := t.TempDir()
+	fields := []string{
+		"pcspkr.author=Foo Bar",
+		"pcspkr.license=GPL",
+		"ext4.description=Fourth Extended Filesystem",
+		"", // a stray NUL produces an empty field that must be skipped
+		"malformed-no-equals-or-dot",
+	}
+	data := []byte(joinNUL(fields))
+	if err := os.WriteFile(filepath.Join(dir, "modules.builtin.modinfo"), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := loadBuiltinInfo(dir)
+	if err != nil {
+		t.Fatalf("loadBuiltinInfo: %s", err)
+	}
+	want := map[string]map[string]string{
+		"pcspkr": {"author": "Foo Bar", "license": "GPL"},
+		"ext4":   {"description": "Fourth Extended Filesystem"},
+	}
+	if !reflect.DeepEqual(info, want) {
+		t.Errorf("loadBuiltinInfo = %v, want %v", info, want)
+	}
+}
+
+func TestLoadBuiltinInfo_Missing(t *testing.T) {
+	info, err := loadBuiltinInfo(t.TempDir())
+	if err != nil {
+		t.Fatalf("loadBuiltinInfo: want nil error for a missing modules.builtin.modinfo, got %s", err)
+	}
+	if len(info) != 0 {
+		t.Errorf("loadBuiltinInfo = %v, want empty", info)
+	}
+}
+
+// joinNUL reproduces modules.builtin.modinfo's NUL-separated field
+// layout from a list of "name.key=value" strings.
+func joinNUL(fields []string) string {
+	var out []byte
+	for _, f := range fields {
+		out = append(out, []byte(f)...)
+		out = append(out, 0)
+	}
+	return string(out)
+}
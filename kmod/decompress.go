@@ -0,0 +1,59 @@
+// Copyright 2017 Tristan Claverie. All rights reserved.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package kmod
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"strings"
+)
+
+// compressedSuffixes lists the .ko suffixes a kernel may understand as
+// compressed module formats.
+var compressedSuffixes = []string{".gz", ".xz", ".zst"}
+
+// isCompressedPath reports whether path carries one of the known
+// compressed module suffixes.
+func isCompressedPath(path string) bool {
+	for _, suffix := range compressedSuffixes {
+		if strings.HasSuffix(path, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultDecompressor is the decompression hook used by NewKmod when no
+// WithDecompressor option is given. It handles .ko.gz with the standard
+// library's compress/gzip and returns an error for any other
+// compression format, since XZ and Zstandard support would otherwise
+// pull github.com/ulikunitz/xz or github.com/klauspost/compress/zstd
+// into every caller regardless of whether they need it.
+func DefaultDecompressor(path string) ([]byte, error) {
+	if !strings.HasSuffix(path, ".gz") {
+		return nil, errUnsupportedCompression(path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	return io.ReadAll(gz)
+}
+
+type errUnsupportedCompression string
+
+func (path errUnsupportedCompression) Error() string {
+	return "kmod: " + string(path) + " is compressed but no decompressor is registered for it"
+}
@@ -0,0 +1,78 @@
+// Copyright 2017 Tristan Claverie. All rights reserved.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package kmod
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsCompressedPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/lib/modules/6.1.0/pcspkr.ko", false},
+		{"/lib/modules/6.1.0/pcspkr.ko.gz", true},
+		{"/lib/modules/6.1.0/pcspkr.ko.xz", true},
+		{"/lib/modules/6.1.0/pcspkr.ko.zst", true},
+		{"pcspkr", false},
+	}
+	for _, tt := range tests {
+		if got := isCompressedPath(tt.path); got != tt.want {
+			t.Errorf("isCompressedPath(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestDefaultDecompressor(t *testing.T) {
+	dir := t.TempDir()
+	want := []byte("fake ELF contents")
+
+	gzPath := filepath.Join(dir, "mod.ko.gz")
+	f, err := os.Create(gzPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz := gzip.NewWriter(f)
+	if _, err := gz.Write(want); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := DefaultDecompressor(gzPath)
+	if err != nil {
+		t.Fatalf("DefaultDecompressor: %s", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("DefaultDecompressor(%q) = %q, want %q", gzPath, got, want)
+	}
+}
+
+func TestDefaultDecompressor_UnsupportedFormat(t *testing.T) {
+	dir := t.TempDir()
+	xzPath := filepath.Join(dir, "mod.ko.xz")
+	if err := os.WriteFile(xzPath, []byte("not really xz"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := DefaultDecompressor(xzPath); err == nil {
+		t.Fatal("DefaultDecompressor: want error for .xz, got nil")
+	}
+}
+
+func TestDefaultDecompressor_MissingFile(t *testing.T) {
+	if _, err := DefaultDecompressor(filepath.Join(t.TempDir(), "missing.ko.gz")); err == nil {
+		t.Fatal("DefaultDecompressor: want error for a missing file, got nil")
+	}
+}
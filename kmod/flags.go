@@ -0,0 +1,68 @@
+// Copyright 2017 Tristan Claverie. All rights reserved.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package kmod
+
+// InsertFlag modifies the behavior of Insert. Flags are combined by
+// passing several of them.
+type InsertFlag int
+
+const (
+	// InsertForce skips the kernel version magic and module version
+	// checks, mirroring `modprobe --force`.
+	InsertForce InsertFlag = 1 << iota
+	// InsertIgnoreLoaded silently does nothing for modules that are
+	// already loaded instead of returning an error for them.
+	InsertIgnoreLoaded
+	// InsertDryRun resolves the dependencies that would be inserted
+	// without actually loading anything.
+	InsertDryRun
+	// InsertApplyBlacklist honors the blacklist directives found in
+	// modprobe.d configuration.
+	InsertApplyBlacklist
+)
+
+func hasInsertFlag(flags []InsertFlag, f InsertFlag) bool {
+	for _, flag := range flags {
+		if flag&f != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// RemoveFlag modifies the behavior of Remove. Flags are combined by
+// passing several of them.
+type RemoveFlag int
+
+const (
+	// RemoveForce removes a module even if the kernel marks it as
+	// unsafe to unload, mirroring `modprobe --force`.
+	RemoveForce RemoveFlag = 1 << iota
+	// RemoveNoWait removes a module without waiting for its reference
+	// count to drop to zero.
+	RemoveNoWait
+)
+
+func hasRemoveFlag(flags []RemoveFlag, f RemoveFlag) bool {
+	for _, flag := range flags {
+		if flag&f != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ActionFunc is called for every module Insert loads or skips,
+// mirroring the print_action callback accepted by
+// kmod_module_probe_insert_module. install is false when the module was
+// already loaded, and command is the modprobe.d "install"/"remove"
+// command that was run instead of the normal insertion, if any.
+type ActionFunc func(moduleName string, install bool, command string)
+
+// RunCommandFunc overrides how Insert runs the "install" command a
+// module's modprobe.d configuration may declare, mirroring the
+// run_install callback accepted by kmod_module_probe_insert_module. A
+// non-nil error aborts the insertion of that module.
+type RunCommandFunc func(moduleName string, command string) error
@@ -0,0 +1,36 @@
+// Copyright 2017 Tristan Claverie. All rights reserved.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package kmod
+
+import "testing"
+
+func TestHasInsertFlag(t *testing.T) {
+	flags := []InsertFlag{InsertForce, InsertDryRun}
+	if !hasInsertFlag(flags, InsertForce) {
+		t.Error("hasInsertFlag(flags, InsertForce) = false, want true")
+	}
+	if !hasInsertFlag(flags, InsertDryRun) {
+		t.Error("hasInsertFlag(flags, InsertDryRun) = false, want true")
+	}
+	if hasInsertFlag(flags, InsertIgnoreLoaded) {
+		t.Error("hasInsertFlag(flags, InsertIgnoreLoaded) = true, want false")
+	}
+	if hasInsertFlag(nil, InsertForce) {
+		t.Error("hasInsertFlag(nil, InsertForce) = true, want false")
+	}
+}
+
+func TestHasRemoveFlag(t *testing.T) {
+	flags := []RemoveFlag{RemoveNoWait}
+	if !hasRemoveFlag(flags, RemoveNoWait) {
+		t.Error("hasRemoveFlag(flags, RemoveNoWait) = false, want true")
+	}
+	if hasRemoveFlag(flags, RemoveForce) {
+		t.Error("hasRemoveFlag(flags, RemoveForce) = true, want false")
+	}
+	if hasRemoveFlag(nil, RemoveForce) {
+		t.Error("hasRemoveFlag(nil, RemoveForce) = true, want false")
+	}
+}
@@ -2,8 +2,16 @@
 // Use of this source code is governed by an Apache
 // license that can be found in the LICENSE file.
 
+//go:build !purego
+// +build !purego
+
 /*Package kmod performs bindings over libkmod to manipulate kernel modules from Golang seemlessly.
 
+This file holds the default, cgo-based backend which links against
+libkmod directly. Build with the "purego" tag to use a pure-Go backend
+that talks to the kernel module syscalls directly instead - see
+purego.go.
+
 libkmod is a well-known library to handle kernel modules and which is used in the kmod set of tools (modprobe, modinfo, depmod etc ...). This Golang wrapper exposes common operations: list installed modules, retrieve information on a module, insert or remove a module from the tree.
 
 The following file shows those abilities in practice are available
@@ -59,13 +67,66 @@ package kmod
 #include <string.h>
 #include <stdio.h>
 #include <stdlib.h>
+#include <stdbool.h>
+#include <stdint.h>
+#include <stdarg.h>
+
+// goRunInstall and goPrintAction are defined in kmod.go with //export;
+// cgo forward-declares them for us in the generated _cgo_export.h.
+// These shims only adapt the const-ness the real libkmod prototypes use.
+static int cgo_run_install(struct kmod_module *mod, const char *cmd, void *data) {
+	return goRunInstall(mod, (char *)cmd, data);
+}
+
+static void cgo_print_action(struct kmod_module *mod, bool install, const char *cmd) {
+	goPrintAction(mod, install ? 1 : 0, (char *)cmd);
+}
+
+// cgo_insert_module does the actual call to kmod_module_probe_insert_module.
+// Passing C function pointers as Go-side call arguments does not work
+// reliably across cgo, so the whole call - including picking which
+// callbacks to register - is kept on the C side. data_handle is the
+// cgo.Handle identifying the *Kmod to invoke a registered
+// RunCommandFunc on, or 0 when none is registered; carrying it as a
+// uintptr_t instead of a void* keeps the Go side free of
+// unsafe.Pointer(uintptr(...)) conversions.
+static int cgo_insert_module(struct kmod_module *mod, unsigned int flags, uintptr_t data_handle) {
+	void *data = data_handle != 0 ? (void *)data_handle : NULL;
+	return kmod_module_probe_insert_module(mod, flags, NULL,
+		data != NULL ? cgo_run_install : NULL, data, cgo_print_action);
+}
+
+// cgo_log_trampoline adapts kmod_set_log_fn's va_list-based callback to
+// goLogCallback, which cgo cannot hand a va_list to directly: the
+// message is formatted here, in C, before crossing into Go.
+static void cgo_log_trampoline(void *data, int priority, const char *file, int line,
+		const char *fn, const char *format, va_list args) {
+	char msg[1024];
+	vsnprintf(msg, sizeof(msg), format, args);
+	goLogCallback((uintptr_t)data, priority, (char *)file, line, (char *)fn, msg);
+}
+
+// cgo_set_log_fn does the actual call to kmod_set_log_fn. As with
+// cgo_insert_module, picking cgo_log_trampoline has to happen on the C
+// side rather than as a Go-side call argument.
+static void cgo_set_log_fn(struct kmod_ctx *ctx, uintptr_t data_handle) {
+	kmod_set_log_fn(ctx, cgo_log_trampoline, (void *)data_handle);
+}
 */
 import "C"
 
 import (
 	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
 	"runtime"
+	"runtime/cgo"
+	"sync"
 	"unsafe"
+
+	"github.com/ElyKar/golang-kmod/signature"
+	"golang.org/x/sys/unix"
 )
 
 // Helper function to get the proper message from an error.
@@ -78,17 +139,130 @@ func goStrerror(err C.int) string {
 // Kmod wraps a kmod_context inside it. When garbage collected, all module handles will be freed by libkmod.
 type Kmod struct {
 	ctx *C.struct_kmod_ctx
+
+	// moduleDir is the directory libkmod was pointed at, resolved to
+	// /lib/modules/`uname -r` when the caller did not set
+	// WithModuleDir. It is used to read modules.builtin and
+	// modules.builtin.modinfo directly, since libkmod has no call to
+	// enumerate built-in modules itself.
+	moduleDir string
+
+	// builtin and builtinInfo hold the contents of modules.builtin and
+	// modules.builtin.modinfo under moduleDir, read once by NewKmod.
+	// libkmod has no call to enumerate built-in modules itself, so this
+	// package reads those files directly; see ListBuiltin and
+	// BuiltinInfo.
+	builtin     map[string]bool
+	builtinInfo map[string]map[string]string
+
+	// decompressor obtains the raw ELF image of a compressed module so
+	// Insert can load it with init_module(2) directly, bypassing
+	// libkmod's own insertion path. See SetDecompressor.
+	decompressor func(path string) ([]byte, error)
+
+	action     ActionFunc
+	runCommand RunCommandFunc
+
+	// logFunc receives libkmod's own diagnostic messages, forwarded by
+	// goLogCallback through cgo_set_log_fn. logHandle is the handle
+	// that call is registered under for as long as ctx lives; see
+	// WithLogger and WithLogFunc.
+	logFunc   LogFunc
+	logHandle cgo.Handle
+}
+
+// printActionMu serializes Insert and ResolveInsertPlan across every
+// *Kmod. kmod_module_probe_insert_module's print_action callback,
+// unlike run_install, carries no user data pointer, so there is no way
+// to route it back to the *Kmod that is currently probing; instead
+// currentPrintAction is a single process-wide slot, and printActionMu
+// is held for the full duration of the call that installs it - not
+// just the instant of swapping the variable - so a second call can
+// never have its notifications delivered to the first call's
+// collector, or vice versa.
+var printActionMu sync.Mutex
+var currentPrintAction ActionFunc
+
+//export goRunInstall
+func goRunInstall(mod *C.struct_kmod_module, cmd *C.char, data unsafe.Pointer) C.int {
+	if data == nil {
+		return -1
+	}
+	kmod, _ := cgo.Handle(uintptr(data)).Value().(*Kmod)
+	if kmod == nil || kmod.runCommand == nil {
+		return -1
+	}
+	name := C.GoString(C.kmod_module_get_name(mod))
+	if err := kmod.runCommand(name, C.GoString(cmd)); err != nil {
+		return -1
+	}
+	return 0
+}
+
+//export goPrintAction
+func goPrintAction(mod *C.struct_kmod_module, install C.int, cmd *C.char) {
+	// libkmod calls this from inside the cgo_insert_module call made by
+	// Insert or ResolveInsertPlan, which already hold printActionMu for
+	// its whole duration; locking it again here would deadlock.
+	action := currentPrintAction
+	if action == nil {
+		return
+	}
+	action(C.GoString(C.kmod_module_get_name(mod)), install != 0, C.GoString(cmd))
+}
+
+//export goLogCallback
+func goLogCallback(data C.uintptr_t, priority C.int, file *C.char, line C.int, fn *C.char, msg *C.char) {
+	kmod, _ := cgo.Handle(uintptr(data)).Value().(*Kmod)
+	if kmod == nil || kmod.logFunc == nil {
+		return
+	}
+	kmod.logFunc(levelForPriority(int(priority)), C.GoString(msg),
+		slog.String("file", C.GoString(file)),
+		slog.Int("line", int(line)),
+		slog.String("func", C.GoString(fn)),
+	)
 }
 
 // NewKmod creates a new context from default directories and configuration files. It will search for modules in /lib/modules/`uname -r` and configuration files in /run/modprobe.d, /etc/modprobe.d and /lib/modprobe.d.
 //
+// Pass WithModuleDir or WithConfigDir to override those defaults.
+//
 // This function returns an error in case the library encounters a problem for creating and populating the context.
 //
 // The returned *Kmod must not be discarded, as releasing it will free the underlying C structure and all the modules in the context.
-func NewKmod() (*Kmod, error) {
+func NewKmod(opts ...Option) (*Kmod, error) {
 	var ctx *C.struct_kmod_ctx
 
-	ctx = C.kmod_new(nil, nil)
+	o := newOptions(opts)
+
+	moduleDir := o.moduleDir
+	if moduleDir == "" {
+		release, err := unameRelease()
+		if err != nil {
+			return nil, fmt.Errorf("Kmod: unable to determine kernel release: %s", err)
+		}
+		moduleDir = filepath.Join(modulesDir, release)
+	}
+
+	var cModuleDir *C.char
+	if o.moduleDir != "" {
+		cModuleDir = C.CString(o.moduleDir)
+		defer C.free(unsafe.Pointer(cModuleDir))
+	}
+
+	var cConfigPaths []*C.char
+	if o.configDir != "" {
+		cConfigDir := C.CString(o.configDir)
+		defer C.free(unsafe.Pointer(cConfigDir))
+		cConfigPaths = []*C.char{cConfigDir, nil}
+	}
+
+	if cConfigPaths != nil {
+		ctx = C.kmod_new(cModuleDir, &cConfigPaths[0])
+	} else {
+		ctx = C.kmod_new(cModuleDir, nil)
+	}
 	if ctx == nil {
 		return nil, fmt.Errorf("Kmod: unable to create the kmod_ctx, leaving now")
 	}
@@ -97,12 +271,94 @@ func NewKmod() (*Kmod, error) {
 		return nil, fmt.Errorf("Kmod: unable to prepare the kmod_ctx, leaving now - %s", goStrerror(-err))
 	}
 
-	ret := &Kmod{ctx}
+	builtin, err := loadBuiltinNames(moduleDir)
+	if err != nil {
+		return nil, fmt.Errorf("Kmod: unable to read modules.builtin: %s", err)
+	}
+
+	builtinInfo, err := loadBuiltinInfo(moduleDir)
+	if err != nil {
+		return nil, fmt.Errorf("Kmod: unable to read modules.builtin.modinfo: %s", err)
+	}
+
+	ret := &Kmod{
+		ctx:          ctx,
+		moduleDir:    moduleDir,
+		builtin:      builtin,
+		builtinInfo:  builtinInfo,
+		decompressor: o.decompressor,
+	}
+
+	if o.logFunc != nil {
+		ret.logFunc = o.logFunc
+		ret.logHandle = cgo.NewHandle(ret)
+		C.cgo_set_log_fn(ctx, C.uintptr_t(ret.logHandle))
+	}
 
 	runtime.SetFinalizer(ret, (*Kmod).cleanup)
 	return ret, nil
 }
 
+// SetLogPriority sets the maximum syslog priority libkmod reports its
+// own diagnostic messages at; messages less severe than priority never
+// reach WithLogger or WithLogFunc. LogDebug is the most verbose.
+func (kmod *Kmod) SetLogPriority(priority int) {
+	C.kmod_set_log_priority(kmod.ctx, C.int(priority))
+}
+
+// SetDecompressor changes the hook Insert uses to obtain the raw ELF
+// image of a compressed module (.ko.gz, .ko.xz, .ko.zst) before loading
+// it with init_module(2).
+func (kmod *Kmod) SetDecompressor(decompressor func(path string) ([]byte, error)) {
+	kmod.decompressor = decompressor
+}
+
+// SetActionCallback registers a callback invoked by Insert for every
+// dependency it loads or skips, mirroring libkmod's print_action.
+func (kmod *Kmod) SetActionCallback(action ActionFunc) {
+	kmod.action = action
+}
+
+// SetRunCommandCallback registers a callback invoked instead of the
+// normal insertion path for a module whose modprobe.d configuration
+// declares an "install" command, mirroring libkmod's run_install. When
+// unset, libkmod runs the command itself through a shell.
+func (kmod *Kmod) SetRunCommandCallback(runCommand RunCommandFunc) {
+	kmod.runCommand = runCommand
+}
+
+// toProbeFlags translates InsertFlag values to the KMOD_PROBE_* bitmask
+// kmod_module_probe_insert_module expects.
+func toProbeFlags(flags []InsertFlag) C.uint {
+	var f C.uint
+	if hasInsertFlag(flags, InsertForce) {
+		f |= C.KMOD_PROBE_FORCE_VERMAGIC | C.KMOD_PROBE_FORCE_MODVERSION
+	}
+	if hasInsertFlag(flags, InsertIgnoreLoaded) {
+		f |= C.KMOD_PROBE_IGNORE_LOADED
+	}
+	if hasInsertFlag(flags, InsertDryRun) {
+		f |= C.KMOD_PROBE_DRY_RUN
+	}
+	if hasInsertFlag(flags, InsertApplyBlacklist) {
+		f |= C.KMOD_PROBE_APPLY_BLACKLIST
+	}
+	return f
+}
+
+// toRemoveFlags translates RemoveFlag values to the KMOD_REMOVE_*
+// bitmask kmod_module_remove_module expects.
+func toRemoveFlags(flags []RemoveFlag) C.uint {
+	var f C.uint
+	if hasRemoveFlag(flags, RemoveForce) {
+		f |= C.KMOD_REMOVE_FORCE
+	}
+	if hasRemoveFlag(flags, RemoveNoWait) {
+		f |= C.KMOD_REMOVE_NOWAIT
+	}
+	return f
+}
+
 // Cleanup the kmod context.
 func (kmod *Kmod) cleanup() {
 	if kmod.ctx != nil {
@@ -110,6 +366,10 @@ func (kmod *Kmod) cleanup() {
 		C.kmod_unref(kmod.ctx)
 		kmod.ctx = nil
 	}
+	if kmod.logHandle != 0 {
+		kmod.logHandle.Delete()
+		kmod.logHandle = 0
+	}
 }
 
 // List returns a slice containing all loaded modules.
@@ -123,7 +383,7 @@ func (kmod *Kmod) List() ([]*Module, error) {
 		return nil, fmt.Errorf("Kmod: couldn't get the list of modules: %s\n", goStrerror(-err))
 	}
 
-	modList := newModuleList(list)
+	modList := newModuleList(kmod, list)
 	return modList.modules, nil
 }
 
@@ -142,7 +402,7 @@ func (kmod *Kmod) Lookup(aliasName string) ([]*Module, error) {
 		return nil, fmt.Errorf("Kmod : Failed to lookup %s - %s", aliasName, goStrerror(-err))
 	}
 
-	modList := newModuleList(list)
+	modList := newModuleList(kmod, list)
 	return modList.modules, nil
 }
 
@@ -158,7 +418,158 @@ func (kmod *Kmod) ModuleFromName(name string) (*Module, error) {
 		return nil, fmt.Errorf("Kmod : Could not get module %s - %s", name, goStrerror(-err))
 	}
 
-	return newModule(module), nil
+	return newModule(kmod, module), nil
+}
+
+// ListBuiltin returns the modules compiled into the running kernel,
+// read from modules.builtin. libkmod has no call to enumerate these, so
+// the returned modules carry only the name and, through Info, whatever
+// modules.builtin.modinfo recorded for them - unlike List or Lookup,
+// they are not backed by a struct kmod_module.
+func (kmod *Kmod) ListBuiltin() ([]*Module, error) {
+	modules := make([]*Module, 0, len(kmod.builtin))
+	for name := range kmod.builtin {
+		modules = append(modules, newBuiltinModule(kmod, name))
+	}
+	return modules, nil
+}
+
+// BuiltinInfo returns the fields modules.builtin.modinfo recorded for
+// the built-in module name, the same information Info returns for
+// modules loaded from disk. It returns an error if
+// modules.builtin.modinfo has no entry for name.
+func (kmod *Kmod) BuiltinInfo(name string) (map[string]string, error) {
+	info, ok := kmod.builtinInfo[name]
+	if !ok {
+		return nil, fmt.Errorf("Kmod: %s is not a built-in module", name)
+	}
+	return info, nil
+}
+
+// IsBuiltin reports whether module is compiled into the running kernel
+// rather than loaded from a .ko file on disk.
+func (module *Module) IsBuiltin() bool {
+	return module.mod == nil || module.kmod.builtin[module.Name()]
+}
+
+// Signature parses the PKCS#7 signature block appended to the
+// module's on-disk .ko file, the same format the kernel's sign-file
+// tool produces for signed modules.
+//
+// The method returns an error if the module has no known on-disk
+// file, for instance because it is built into the kernel - see
+// IsBuiltin - or if the file carries no signature.
+func (module *Module) Signature() (*signature.Info, error) {
+	if module.mod == nil {
+		return nil, fmt.Errorf("Kmod: built-in module %s has no on-disk file to sign", module.Name())
+	}
+
+	path := C.GoString(C.kmod_module_get_path(module.mod))
+	if path == "" {
+		return nil, fmt.Errorf("Kmod: no on-disk file for module %s", module.Name())
+	}
+
+	var image []byte
+	var err error
+	if isCompressedPath(path) {
+		image, err = module.kmod.decompressor(path)
+	} else {
+		image, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return signature.Parse(image)
+}
+
+// Dependencies returns the modules module directly depends on.
+//
+// It returns an empty slice, not an error, for a built-in module.
+func (module *Module) Dependencies() ([]*Module, error) {
+	if module.mod == nil {
+		return nil, nil
+	}
+	list := C.kmod_module_get_dependencies(module.mod)
+	return newModuleList(module.kmod, list).modules, nil
+}
+
+// SoftDependencies returns the modules declared through
+// MODULE_SOFTDEP as pre- and post-dependencies: modules modprobe loads
+// before and after this one without this one depending on their
+// symbols.
+//
+// It returns two empty slices, not an error, for a built-in module.
+func (module *Module) SoftDependencies() (pre, post []*Module, err error) {
+	if module.mod == nil {
+		return nil, nil, nil
+	}
+
+	var cPre, cPost *C.struct_kmod_list
+	if errCode := C.kmod_module_get_softdeps(module.mod, &cPre, &cPost); errCode < 0 {
+		return nil, nil, fmt.Errorf("Kmod: could not get soft dependencies of %s - %s", module.Name(), goStrerror(-errCode))
+	}
+	return newModuleList(module.kmod, cPre).modules, newModuleList(module.kmod, cPost).modules, nil
+}
+
+// Holders returns the modules and other kernel references currently
+// keeping module loaded.
+//
+// It returns an empty slice, not an error, for a module that is not
+// currently loaded.
+func (module *Module) Holders() ([]*Module, error) {
+	if module.mod == nil {
+		return nil, nil
+	}
+	list := C.kmod_module_get_holders(module.mod)
+	return newModuleList(module.kmod, list).modules, nil
+}
+
+// ResolveInsertPlan returns the modules Insert would load for name and
+// its dependencies, in the order Insert would load them, without
+// loading anything - the same resolution InsertDryRun drives, exposed
+// so callers can inspect or reorder it themselves.
+func (kmod *Kmod) ResolveInsertPlan(name string) ([]*Module, error) {
+	modules, err := kmod.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+
+	printActionMu.Lock()
+	defer printActionMu.Unlock()
+
+	var names []string
+	currentPrintAction = func(moduleName string, install bool, command string) {
+		if install {
+			names = append(names, moduleName)
+		}
+	}
+	defer func() { currentPrintAction = nil }()
+
+	for _, module := range modules {
+		path := C.GoString(C.kmod_module_get_path(module.mod))
+		if isCompressedPath(path) {
+			// Insert loads a compressed module directly through the
+			// configured decompressor instead of asking libkmod to
+			// probe it - see Insert - so mirror that here rather than
+			// depending on libkmod's own, possibly absent, xz/zstd
+			// support for the dry run.
+			names = append(names, module.Name())
+			continue
+		}
+		if errCode := C.cgo_insert_module(module.mod, C.KMOD_PROBE_DRY_RUN, 0); errCode < 0 {
+			return nil, fmt.Errorf("Kmod: could not resolve insert plan for %s - %s", name, goStrerror(-errCode))
+		}
+	}
+
+	plan := make([]*Module, 0, len(names))
+	for _, n := range names {
+		module, err := kmod.ModuleFromName(n)
+		if err != nil {
+			return nil, err
+		}
+		plan = append(plan, module)
+	}
+	return plan, nil
 }
 
 // Insert a module in the tree with its name.
@@ -171,7 +582,16 @@ func (kmod *Kmod) ModuleFromName(name string) (*Module, error) {
 //     kmod.Insert("pcspkr")
 //
 // If this module depends on others that are not yet loaded, depencies will be loaded.
-func (kmod *Kmod) Insert(name string) error {
+//
+// Pass InsertForce, InsertIgnoreLoaded, InsertDryRun or InsertApplyBlacklist
+// to change that behavior. Use SetActionCallback and
+// SetRunCommandCallback to observe or override per-dependency actions.
+//
+// A compressed module (.ko.gz, .ko.xz, .ko.zst) is decompressed with the
+// configured decompressor and loaded on its own with init_module(2): its
+// dependencies are not loaded, and InsertForce and InsertApplyBlacklist
+// have no effect on it.
+func (kmod *Kmod) Insert(name string, flags ...InsertFlag) error {
 	var errCode C.int
 	modules, err := kmod.Lookup(name)
 
@@ -179,8 +599,54 @@ func (kmod *Kmod) Insert(name string) error {
 		return err
 	}
 
+	probeFlags := toProbeFlags(flags)
+	dryRun := hasInsertFlag(flags, InsertDryRun)
+	ignoreLoaded := hasInsertFlag(flags, InsertIgnoreLoaded)
+
+	// print_action fires for every module cgo_insert_module probes
+	// below whether or not kmod.action is set, so printActionMu must
+	// be held for the whole call - see its comment - even when there
+	// is nothing for this *Kmod to do with the notification.
+	printActionMu.Lock()
+	defer printActionMu.Unlock()
+	currentPrintAction = kmod.action
+	defer func() { currentPrintAction = nil }()
+
 	for _, module := range modules {
-		errCode = C.kmod_module_probe_insert_module(module.mod, 0, nil, nil, nil, nil)
+		path := C.GoString(C.kmod_module_get_path(module.mod))
+		if isCompressedPath(path) {
+			if dryRun {
+				if kmod.action != nil {
+					kmod.action(module.Name(), true, "")
+				}
+				continue
+			}
+			image, err := kmod.decompressor(path)
+			if err != nil {
+				return fmt.Errorf("Could not decompress module %s : %s", module.Name(), err)
+			}
+			if err := unix.InitModule(image, ""); err != nil {
+				if err == unix.EEXIST && ignoreLoaded {
+					if kmod.action != nil {
+						kmod.action(module.Name(), false, "")
+					}
+					continue
+				}
+				return fmt.Errorf("Could not insert module %s : %s", module.Name(), err)
+			}
+			if kmod.action != nil {
+				kmod.action(module.Name(), true, "")
+			}
+			continue
+		}
+
+		var handle C.uintptr_t
+		if kmod.runCommand != nil {
+			h := cgo.NewHandle(kmod)
+			handle = C.uintptr_t(h)
+			defer h.Delete()
+		}
+		errCode = C.cgo_insert_module(module.mod, probeFlags, handle)
 		if errCode < 0 {
 			return fmt.Errorf("Could not insert module %s : %s", module.Name(), goStrerror(-errCode))
 		}
@@ -197,7 +663,9 @@ func (kmod *Kmod) Insert(name string) error {
 //
 //     kmod := NewKmod()
 //     kmod.Remove("pcspkr")
-func (kmod *Kmod) Remove(name string) error {
+//
+// Pass RemoveForce or RemoveNoWait to change that behavior.
+func (kmod *Kmod) Remove(name string, flags ...RemoveFlag) error {
 	var errCode C.int
 	modules, err := kmod.Lookup(name)
 
@@ -205,8 +673,10 @@ func (kmod *Kmod) Remove(name string) error {
 		return err
 	}
 
+	removeFlags := toRemoveFlags(flags)
+
 	for _, module := range modules {
-		errCode = C.kmod_module_remove_module(module.mod, 0)
+		errCode = C.kmod_module_remove_module(module.mod, removeFlags)
 		if errCode < 0 {
 			return fmt.Errorf("Could not remove module %s : %s", module.Name(), goStrerror(-errCode))
 		}
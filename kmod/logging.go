@@ -0,0 +1,63 @@
+// Copyright 2017 Tristan Claverie. All rights reserved.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package kmod
+
+import (
+	"context"
+	"log/slog"
+)
+
+// LogFunc receives one diagnostic message from a Kmod backend: libkmod
+// itself for the cgo backend, or this package's own operational
+// messages for the purego backend. The cgo backend adds the "file",
+// "line" and "func" attrs libkmod reports for the message; the purego
+// backend does not add them.
+type LogFunc func(level slog.Level, msg string, attrs ...slog.Attr)
+
+// Syslog priorities a Kmod backend may log at; see kmod_set_log_fn and
+// <sys/syslog.h>. SetLogPriority caps which of these actually reach the
+// configured LogFunc.
+const (
+	LogErr     = 3
+	LogWarning = 4
+	LogNotice  = 5
+	LogInfo    = 6
+	LogDebug   = 7
+)
+
+// levelForPriority maps a syslog priority to the slog.Level WithLogger
+// and WithLogFunc report it at: LogErr to Error, LogWarning to Warn,
+// LogNotice and LogInfo to Info, anything less severe (LogDebug) to
+// Debug.
+func levelForPriority(priority int) slog.Level {
+	switch {
+	case priority <= LogErr:
+		return slog.LevelError
+	case priority == LogWarning:
+		return slog.LevelWarn
+	case priority <= LogInfo:
+		return slog.LevelInfo
+	default:
+		return slog.LevelDebug
+	}
+}
+
+// WithLogger routes a backend's own diagnostic messages - module load
+// failures, blacklist decisions, parse errors and the like - into
+// logger instead of stderr.
+func WithLogger(logger *slog.Logger) Option {
+	return WithLogFunc(func(level slog.Level, msg string, attrs ...slog.Attr) {
+		logger.LogAttrs(context.Background(), level, msg, attrs...)
+	})
+}
+
+// WithLogFunc routes a backend's own diagnostic messages through fn
+// instead of a *slog.Logger, for callers who want full control over
+// how the attrs it carries are recorded.
+func WithLogFunc(fn LogFunc) Option {
+	return func(o *options) {
+		o.logFunc = fn
+	}
+}
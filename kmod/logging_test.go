@@ -0,0 +1,30 @@
+// Copyright 2017 Tristan Claverie. All rights reserved.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package kmod
+
+import (
+	"log/slog"
+	"testing"
+)
+
+func TestLevelForPriority(t *testing.T) {
+	tests := []struct {
+		priority int
+		want     slog.Level
+	}{
+		{0, slog.LevelError},
+		{LogErr, slog.LevelError},
+		{LogWarning, slog.LevelWarn},
+		{LogNotice, slog.LevelInfo},
+		{LogInfo, slog.LevelInfo},
+		{LogDebug, slog.LevelDebug},
+		{LogDebug + 1, slog.LevelDebug},
+	}
+	for _, tt := range tests {
+		if got := levelForPriority(tt.priority); got != tt.want {
+			t.Errorf("levelForPriority(%d) = %v, want %v", tt.priority, got, tt.want)
+		}
+	}
+}
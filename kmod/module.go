@@ -0,0 +1,115 @@
+// Copyright 2017 Tristan Claverie. All rights reserved.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+//go:build !purego
+// +build !purego
+
+package kmod
+
+/*
+#include <libkmod.h>
+#include <stdlib.h>
+*/
+import "C"
+
+import "fmt"
+
+// Module wraps a single kernel module as known to libkmod. A Module
+// returned by List, Lookup or ModuleFromName carries a struct
+// kmod_module handle; a Module returned by ListBuiltin carries only a
+// name - see IsBuiltin.
+type Module struct {
+	kmod *Kmod
+	mod  *C.struct_kmod_module
+
+	// name backs Name for a Module created by newBuiltinModule, which
+	// has no struct kmod_module to ask.
+	name string
+}
+
+// newModule wraps a kmod_module handle already produced by libkmod,
+// for instance by kmod_module_new_from_name.
+func newModule(kmod *Kmod, mod *C.struct_kmod_module) *Module {
+	return &Module{kmod: kmod, mod: mod}
+}
+
+// newBuiltinModule creates a Module for a module compiled into the
+// running kernel, backed by modules.builtin(.modinfo) rather than a
+// struct kmod_module - see Kmod.ListBuiltin.
+func newBuiltinModule(kmod *Kmod, name string) *Module {
+	return &Module{kmod: kmod, name: name}
+}
+
+// moduleList wraps a struct kmod_list of kmod_module entries, as
+// returned by kmod_module_new_from_loaded, kmod_module_new_from_lookup
+// and the kmod_module_get_* accessors.
+type moduleList struct {
+	modules []*Module
+}
+
+// newModuleList walks list, wrapping each kmod_module entry, and
+// releases the list itself - not the modules, which keep their own
+// libkmod reference.
+func newModuleList(kmod *Kmod, list *C.struct_kmod_list) *moduleList {
+	ml := &moduleList{}
+	for entry := list; entry != nil; entry = C.kmod_list_next(list, entry) {
+		ml.modules = append(ml.modules, newModule(kmod, C.kmod_module_get_module(entry)))
+	}
+	if list != nil {
+		C.kmod_module_unref_list(list)
+	}
+	return ml
+}
+
+// Name returns the module's name.
+func (module *Module) Name() string {
+	if module.mod == nil {
+		return module.name
+	}
+	return C.GoString(C.kmod_module_get_name(module.mod))
+}
+
+// Size returns the module's size in memory, in bytes, as reported by
+// /proc/modules. It is zero for a built-in module - see IsBuiltin.
+func (module *Module) Size() int64 {
+	if module.mod == nil {
+		return 0
+	}
+	return int64(C.kmod_module_get_size(module.mod))
+}
+
+// RefCount returns the number of other modules and references holding
+// this module loaded. It is zero for a built-in module - see IsBuiltin.
+func (module *Module) RefCount() int {
+	if module.mod == nil {
+		return 0
+	}
+	return int(C.kmod_module_get_refcnt(module.mod))
+}
+
+// Info returns the module's key/value metadata (author, description,
+// license, depends, ...).
+//
+// For a built-in module - see IsBuiltin - this is sourced from
+// modules.builtin.modinfo instead of a struct kmod_module, since the
+// module has no on-disk .ko file for libkmod to read.
+func (module *Module) Info() (map[string]string, error) {
+	if module.mod == nil {
+		return module.kmod.BuiltinInfo(module.name)
+	}
+
+	var list *C.struct_kmod_list
+	if err := C.kmod_module_get_info(module.mod, &list); err < 0 {
+		return nil, fmt.Errorf("Kmod: could not get info for module %s - %s", module.Name(), goStrerror(-err))
+	}
+	defer C.kmod_module_info_free_list(list)
+
+	info := map[string]string{}
+	for entry := list; entry != nil; entry = C.kmod_list_next(list, entry) {
+		key := C.GoString(C.kmod_module_info_get_key(entry))
+		value := C.GoString(C.kmod_module_info_get_value(entry))
+		info[key] = value
+	}
+	return info, nil
+}
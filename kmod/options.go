@@ -0,0 +1,54 @@
+// Copyright 2017 Tristan Claverie. All rights reserved.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package kmod
+
+// options holds the configuration shared by every Kmod backend. Each
+// backend reads the fields it understands and ignores the rest.
+type options struct {
+	moduleDir    string
+	configDir    string
+	decompressor func(path string) ([]byte, error)
+	logFunc      LogFunc
+}
+
+// Option configures a Kmod instance created by NewKmod.
+type Option func(*options)
+
+// WithModuleDir makes NewKmod look for modules under dir instead of
+// /lib/modules/`uname -r`. It mirrors the directory name argument of
+// kmod_new.
+func WithModuleDir(dir string) Option {
+	return func(o *options) {
+		o.moduleDir = dir
+	}
+}
+
+// WithConfigDir makes NewKmod read modprobe.d-style configuration from
+// dir instead of the default /run/modprobe.d, /etc/modprobe.d and
+// /lib/modprobe.d locations. It mirrors the config_paths argument of
+// kmod_new.
+func WithConfigDir(dir string) Option {
+	return func(o *options) {
+		o.configDir = dir
+	}
+}
+
+// WithDecompressor sets the hook Insert uses to obtain the raw ELF
+// image of a compressed module (.ko.gz, .ko.xz, .ko.zst) before loading
+// it with init_module(2). If not given, NewKmod uses
+// DefaultDecompressor, which only understands gzip.
+func WithDecompressor(decompressor func(path string) ([]byte, error)) Option {
+	return func(o *options) {
+		o.decompressor = decompressor
+	}
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{decompressor: DefaultDecompressor}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
@@ -0,0 +1,704 @@
+// Copyright 2017 Tristan Claverie. All rights reserved.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+//go:build purego
+// +build purego
+
+// Package kmod (purego backend) implements the same surface as the
+// default, cgo-based backend without linking against libkmod. It
+// resolves dependencies and aliases by reading modules.dep,
+// modules.alias and modules.builtin under the module directory, and
+// loads/unloads modules with the finit_module(2), init_module(2) and
+// delete_module(2) syscalls directly. This makes the package usable
+// from minimal containers and statically cross-compiled binaries where
+// libkmod and its headers are not available.
+//
+// Build with the "purego" tag to select this backend:
+//
+//	go build -tags purego ./...
+package kmod
+
+import (
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ElyKar/golang-kmod/signature"
+	"golang.org/x/sys/unix"
+)
+
+// depEntry describes one line of modules.dep: the path to a module and
+// the paths of the modules it depends on, in load order.
+type depEntry struct {
+	path string
+	deps []string
+}
+
+// aliasEntry describes one line of modules.alias: a glob pattern and
+// the module name it resolves to.
+type aliasEntry struct {
+	pattern string
+	module  string
+}
+
+// Kmod resolves and (un)loads kernel modules without linking against
+// libkmod. Unlike the cgo backend it holds no native resources, so
+// there is no finalizer to release anything.
+type Kmod struct {
+	moduleDir string
+
+	// byName indexes depEntry by the module name derived from its file
+	// name (dashes normalized to underscores, compression and .ko
+	// suffixes stripped).
+	byName      map[string]*depEntry
+	alias       []aliasEntry
+	builtin     map[string]bool
+	builtinInfo map[string]map[string]string
+
+	decompressor func(path string) ([]byte, error)
+	action       ActionFunc
+	runCommand   RunCommandFunc
+
+	// logFunc and logPriority back SetLogPriority and WithLogger /
+	// WithLogFunc. This backend links against no library that could
+	// supply file/line/function for its own messages, so log reports
+	// no such attrs, only the ones its callers pass.
+	logFunc     LogFunc
+	logPriority int
+}
+
+// NewKmod creates a new resolver rooted at /lib/modules/`uname -r`,
+// reading modules.dep, modules.alias and modules.builtin eagerly, the
+// same way kmod_load_resources populates the cgo backend's context.
+//
+// Pass WithModuleDir to override the default module directory.
+// WithConfigDir is accepted for API parity with the cgo backend but has
+// no effect here: this backend resolves dependencies and aliases only,
+// it does not apply modprobe.d configuration.
+func NewKmod(opts ...Option) (*Kmod, error) {
+	o := newOptions(opts)
+
+	dir := o.moduleDir
+	if dir == "" {
+		release, err := unameRelease()
+		if err != nil {
+			return nil, fmt.Errorf("Kmod: unable to determine kernel release: %s", err)
+		}
+		dir = filepath.Join(modulesDir, release)
+	}
+
+	k := &Kmod{
+		moduleDir:    dir,
+		byName:       map[string]*depEntry{},
+		decompressor: o.decompressor,
+		logFunc:      o.logFunc,
+		logPriority:  LogInfo,
+	}
+
+	if err := k.loadDep(); err != nil {
+		return nil, err
+	}
+	if err := k.loadAlias(); err != nil {
+		return nil, err
+	}
+
+	builtin, err := loadBuiltinNames(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Kmod: unable to read modules.builtin: %s", err)
+	}
+	k.builtin = builtin
+
+	builtinInfo, err := loadBuiltinInfo(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Kmod: unable to read modules.builtin.modinfo: %s", err)
+	}
+	k.builtinInfo = builtinInfo
+
+	return k, nil
+}
+
+// ListBuiltin returns the modules compiled into the running kernel,
+// read from modules.builtin.
+func (kmod *Kmod) ListBuiltin() ([]*Module, error) {
+	modules := make([]*Module, 0, len(kmod.builtin))
+	for name := range kmod.builtin {
+		modules = append(modules, &Module{kmod: kmod, name: name, builtin: true})
+	}
+	return modules, nil
+}
+
+// BuiltinInfo returns the fields modules.builtin.modinfo recorded for
+// the built-in module name, the same information Info returns for
+// modules loaded from disk. It returns an error if
+// modules.builtin.modinfo has no entry for name.
+func (kmod *Kmod) BuiltinInfo(name string) (map[string]string, error) {
+	info, ok := kmod.builtinInfo[name]
+	if !ok {
+		return nil, fmt.Errorf("Kmod: %s is not a built-in module", name)
+	}
+	return info, nil
+}
+
+func (kmod *Kmod) loadDep() error {
+	f, err := os.Open(filepath.Join(kmod.moduleDir, "modules.dep"))
+	if err != nil {
+		return fmt.Errorf("Kmod: unable to read modules.dep: %s", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		path, rest, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		entry := &depEntry{path: strings.TrimSpace(path), deps: strings.Fields(rest)}
+		kmod.byName[moduleName(entry.path)] = entry
+	}
+	return scanner.Err()
+}
+
+func (kmod *Kmod) loadAlias() error {
+	f, err := os.Open(filepath.Join(kmod.moduleDir, "modules.alias"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("Kmod: unable to read modules.alias: %s", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || fields[0] != "alias" {
+			continue
+		}
+		kmod.alias = append(kmod.alias, aliasEntry{pattern: fields[1], module: fields[2]})
+	}
+	return scanner.Err()
+}
+
+// resolveAlias returns the module name 'name' resolves to: itself if it
+// is already a known module or builtin, otherwise the first
+// modules.alias pattern it matches.
+func (kmod *Kmod) resolveAlias(name string) (string, error) {
+	normalized := strings.ReplaceAll(name, "-", "_")
+	if _, ok := kmod.byName[normalized]; ok {
+		return normalized, nil
+	}
+	if kmod.builtin[normalized] {
+		return normalized, nil
+	}
+	for _, a := range kmod.alias {
+		if ok, _ := filepath.Match(a.pattern, name); ok {
+			return a.module, nil
+		}
+	}
+	return "", fmt.Errorf("Kmod: module %s not found", name)
+}
+
+// List returns a slice containing all loaded modules, read from
+// /proc/modules.
+func (kmod *Kmod) List() ([]*Module, error) {
+	f, err := os.Open("/proc/modules")
+	if err != nil {
+		return nil, fmt.Errorf("Kmod: couldn't get the list of modules: %s", err)
+	}
+	defer f.Close()
+
+	var modules []*Module
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Kmod: couldn't parse /proc/modules: %s", err)
+		}
+		refcount, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("Kmod: couldn't parse /proc/modules: %s", err)
+		}
+		module := &Module{kmod: kmod, name: fields[0], size: size, refcount: refcount}
+		if len(fields) >= 4 && fields[3] != "-" {
+			module.holders = strings.Split(fields[3], ",")
+		}
+		modules = append(modules, module)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Kmod: couldn't get the list of modules: %s", err)
+	}
+	return modules, nil
+}
+
+// Lookup returns a slice of all modules matching 'aliasName'.
+//
+// The method returns an error in case the lookup fails.
+func (kmod *Kmod) Lookup(aliasName string) ([]*Module, error) {
+	name, err := kmod.resolveAlias(aliasName)
+	if err != nil {
+		return nil, fmt.Errorf("Kmod : Failed to lookup %s - %s", aliasName, err)
+	}
+	_, onDisk := kmod.byName[name]
+	return []*Module{{kmod: kmod, name: name, builtin: !onDisk && kmod.builtin[name]}}, nil
+}
+
+// ModuleFromName returns a module handle from its name.
+//
+// The method returns an error if the module could not be found.
+func (kmod *Kmod) ModuleFromName(name string) (*Module, error) {
+	normalized := strings.ReplaceAll(name, "-", "_")
+	_, onDisk := kmod.byName[normalized]
+	if !onDisk && !kmod.builtin[normalized] {
+		return nil, fmt.Errorf("Kmod : Could not get module %s - not found", name)
+	}
+	return &Module{kmod: kmod, name: normalized, builtin: !onDisk}, nil
+}
+
+// resolveInsertOrder walks the dependency graph of name depth-first and
+// returns its dependencies followed by name itself, in the order they
+// must be loaded.
+func (kmod *Kmod) resolveInsertOrder(name string) ([]*depEntry, error) {
+	resolved, err := kmod.resolveAlias(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var order []*depEntry
+	seen := map[string]bool{}
+
+	var visit func(n string) error
+	visit = func(n string) error {
+		if seen[n] {
+			return nil
+		}
+		seen[n] = true
+		entry, ok := kmod.byName[n]
+		if !ok {
+			if kmod.builtin[n] {
+				return nil
+			}
+			return fmt.Errorf("module %s not found", n)
+		}
+		for _, dep := range entry.deps {
+			if err := visit(moduleName(dep)); err != nil {
+				return err
+			}
+		}
+		order = append(order, entry)
+		return nil
+	}
+
+	if err := visit(resolved); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// ResolveInsertPlan returns the modules Insert would load for name and
+// its dependencies, in the order Insert would load them, without
+// loading anything - the same resolution InsertDryRun drives, exposed
+// so callers can inspect or reorder it themselves.
+func (kmod *Kmod) ResolveInsertPlan(name string) ([]*Module, error) {
+	order, err := kmod.resolveInsertOrder(name)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := make([]*Module, 0, len(order))
+	for _, entry := range order {
+		plan = append(plan, &Module{kmod: kmod, name: moduleName(entry.path)})
+	}
+	return plan, nil
+}
+
+// loadModuleFile loads a single .ko file with finit_module(2), falling
+// back to the configured decompressor plus init_module(2) when the
+// kernel rejects the file descriptor - which happens for compressed
+// modules, since finit_module never decompresses them itself.
+func (kmod *Kmod) loadModuleFile(path string, moduleFlags int) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = unix.FinitModule(int(f.Fd()), "", moduleFlags)
+	if err == nil {
+		return nil
+	}
+	if err != unix.ENOEXEC && err != unix.EINVAL {
+		return err
+	}
+
+	image, decompErr := kmod.decompressor(path)
+	if decompErr != nil {
+		return decompErr
+	}
+	return unix.InitModule(image, "")
+}
+
+// SetDecompressor changes the hook used to decompress .ko.gz/.ko.xz/.ko.zst
+// modules before loading them with init_module(2).
+func (kmod *Kmod) SetDecompressor(decompressor func(path string) ([]byte, error)) {
+	kmod.decompressor = decompressor
+}
+
+// SetActionCallback registers a callback invoked for every module
+// Insert loads or skips.
+func (kmod *Kmod) SetActionCallback(action ActionFunc) {
+	kmod.action = action
+}
+
+// SetRunCommandCallback registers a callback invoked in place of the
+// normal insertion path for a module whose modprobe.d configuration
+// declares an "install" command.
+//
+// This backend does not parse modprobe.d configuration, so the
+// callback is accepted for API parity with the cgo backend but is
+// never invoked.
+func (kmod *Kmod) SetRunCommandCallback(runCommand RunCommandFunc) {
+	kmod.runCommand = runCommand
+}
+
+func (kmod *Kmod) reportAction(name string, install bool) {
+	if kmod.action != nil {
+		kmod.action(name, install, "")
+	}
+}
+
+// SetLogPriority sets the maximum syslog priority this backend reports
+// its own operational messages at; messages less severe than priority
+// never reach WithLogger or WithLogFunc. LogDebug is the most verbose.
+func (kmod *Kmod) SetLogPriority(priority int) {
+	kmod.logPriority = priority
+}
+
+// log reports one of this backend's own operational messages through
+// the configured LogFunc, if any, and if priority is severe enough to
+// pass the threshold SetLogPriority set.
+func (kmod *Kmod) log(priority int, msg string, attrs ...slog.Attr) {
+	if kmod.logFunc == nil || priority > kmod.logPriority {
+		return
+	}
+	kmod.logFunc(levelForPriority(priority), msg, attrs...)
+}
+
+func (kmod *Kmod) isLoaded(name string) bool {
+	loaded, err := kmod.List()
+	if err != nil {
+		return false
+	}
+	for _, module := range loaded {
+		if module.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Insert a module in the tree with its name.
+//
+// It returns an error if the module could not be found or if it could
+// not be inserted.
+//
+// If this module depends on others that are not yet loaded, dependencies
+// will be loaded first. Pass InsertForce, InsertIgnoreLoaded or
+// InsertDryRun to change that behavior; InsertApplyBlacklist is accepted
+// for API parity with the cgo backend but has no effect, since this
+// backend does not parse modprobe.d blacklist directives.
+func (kmod *Kmod) Insert(name string, flags ...InsertFlag) error {
+	order, err := kmod.resolveInsertOrder(name)
+	if err != nil {
+		return err
+	}
+
+	ignoreLoaded := hasInsertFlag(flags, InsertIgnoreLoaded)
+	dryRun := hasInsertFlag(flags, InsertDryRun)
+	var moduleFlags int
+	if hasInsertFlag(flags, InsertForce) {
+		moduleFlags |= unix.MODULE_INIT_IGNORE_VERMAGIC | unix.MODULE_INIT_IGNORE_MODVERSIONS
+	}
+
+	for _, entry := range order {
+		name := moduleName(entry.path)
+
+		if ignoreLoaded && kmod.isLoaded(name) {
+			kmod.reportAction(name, false)
+			continue
+		}
+		if dryRun {
+			kmod.reportAction(name, true)
+			continue
+		}
+
+		if err := kmod.loadModuleFile(entry.path, moduleFlags); err != nil {
+			if err == unix.EEXIST && ignoreLoaded {
+				kmod.reportAction(name, false)
+				continue
+			}
+			kmod.log(LogErr, fmt.Sprintf("could not insert module %s: %s", name, err), slog.String("module", name))
+			return fmt.Errorf("Could not insert module %s : %s", name, err)
+		}
+		kmod.log(LogInfo, fmt.Sprintf("inserted module %s", name), slog.String("module", name))
+		kmod.reportAction(name, true)
+	}
+
+	return nil
+}
+
+// Remove a module from the current tree using its name.
+//
+// It returns an error if the module could not be found or could not be
+// removed.
+func (kmod *Kmod) Remove(name string, flags ...RemoveFlag) error {
+	resolved, err := kmod.resolveAlias(name)
+	if err != nil {
+		return err
+	}
+
+	var removeFlags int
+	if hasRemoveFlag(flags, RemoveForce) {
+		removeFlags |= unix.O_TRUNC
+	}
+	if hasRemoveFlag(flags, RemoveNoWait) {
+		removeFlags |= unix.O_NONBLOCK
+	}
+
+	if err := unix.DeleteModule(resolved, removeFlags); err != nil {
+		kmod.log(LogErr, fmt.Sprintf("could not remove module %s: %s", resolved, err), slog.String("module", resolved))
+		return fmt.Errorf("Could not remove module %s : %s", resolved, err)
+	}
+	kmod.log(LogInfo, fmt.Sprintf("removed module %s", resolved), slog.String("module", resolved))
+	return nil
+}
+
+// Module represents a kernel module known to the purego backend, either
+// loaded (as reported by /proc/modules) or resolved from modules.dep.
+type Module struct {
+	kmod *Kmod
+
+	name     string
+	size     int64
+	refcount int
+	holders  []string
+	builtin  bool
+}
+
+// Name returns the module's name.
+func (module *Module) Name() string {
+	return module.name
+}
+
+// IsBuiltin reports whether the module is compiled into the running
+// kernel rather than loaded from an on-disk .ko file.
+func (module *Module) IsBuiltin() bool {
+	return module.builtin
+}
+
+// Size returns the module's size in memory, in bytes, as reported by
+// /proc/modules. It is zero for modules that are not currently loaded.
+func (module *Module) Size() int64 {
+	return module.size
+}
+
+// RefCount returns the number of other modules and references holding
+// this module loaded.
+func (module *Module) RefCount() int {
+	return module.refcount
+}
+
+// Info returns the module's key/value metadata (author, description,
+// license, depends, ...), read from the .modinfo ELF section of its
+// on-disk .ko file. For a built-in module - see IsBuiltin - it is read
+// from modules.builtin.modinfo instead.
+//
+// The method returns an error if the module has no known on-disk file,
+// or if it is built in and modules.builtin.modinfo has no entry for it.
+func (module *Module) Info() (map[string]string, error) {
+	if module.builtin {
+		info, ok := module.kmod.builtinInfo[module.name]
+		if !ok {
+			return nil, fmt.Errorf("Kmod: no modules.builtin.modinfo entry for module %s", module.name)
+		}
+		return info, nil
+	}
+
+	entry, ok := module.kmod.byName[module.name]
+	if !ok {
+		return nil, fmt.Errorf("Kmod: no on-disk file for module %s", module.name)
+	}
+	return readModinfoSection(entry.path, module.kmod.decompressor)
+}
+
+// Dependencies returns the modules module directly depends on, read
+// from modules.dep. It returns an empty slice for a built-in module,
+// since modules.dep tracks only on-disk dependencies.
+func (module *Module) Dependencies() ([]*Module, error) {
+	entry, ok := module.kmod.byName[module.name]
+	if !ok {
+		return nil, nil
+	}
+
+	deps := make([]*Module, 0, len(entry.deps))
+	for _, dep := range entry.deps {
+		deps = append(deps, &Module{kmod: module.kmod, name: moduleName(dep)})
+	}
+	return deps, nil
+}
+
+// SoftDependencies returns the modules declared through
+// MODULE_SOFTDEP as pre- and post-dependencies: modules modprobe loads
+// before and after this one without this one depending on their
+// symbols. They are parsed from the "softdep" field of the module's
+// on-disk .modinfo; built-in modules carry no such field, so both
+// slices are empty for them.
+func (module *Module) SoftDependencies() (pre, post []*Module, err error) {
+	if module.builtin {
+		return nil, nil, nil
+	}
+
+	info, err := module.Info()
+	if err != nil {
+		return nil, nil, err
+	}
+	return parseSoftdep(module.kmod, info["softdep"])
+}
+
+// parseSoftdep turns a "pre: foo bar post: baz" softdep field, the
+// format MODULE_SOFTDEP generates, into the modules it names.
+func parseSoftdep(kmod *Kmod, field string) (pre, post []*Module, err error) {
+	var bucket *[]*Module
+	for _, word := range strings.Fields(field) {
+		switch word {
+		case "pre:":
+			bucket = &pre
+			continue
+		case "post:":
+			bucket = &post
+			continue
+		}
+		if bucket == nil {
+			continue
+		}
+		*bucket = append(*bucket, &Module{kmod: kmod, name: word})
+	}
+	return pre, post, nil
+}
+
+// Holders returns the modules and other kernel references currently
+// keeping module loaded, as reported by /proc/modules. It returns an
+// empty slice for a module that is not currently loaded.
+func (module *Module) Holders() ([]*Module, error) {
+	loaded, err := module.kmod.List()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range loaded {
+		if m.name != module.name {
+			continue
+		}
+		holders := make([]*Module, 0, len(m.holders))
+		for _, name := range m.holders {
+			holders = append(holders, &Module{kmod: module.kmod, name: name})
+		}
+		return holders, nil
+	}
+	return nil, nil
+}
+
+// Signature parses the PKCS#7 signature block appended to the
+// module's on-disk .ko file, the same format the kernel's sign-file
+// tool produces for signed modules.
+//
+// The method returns an error if the module has no known on-disk
+// file, for instance because it is built into the kernel - see
+// IsBuiltin - or if the file carries no signature.
+func (module *Module) Signature() (*signature.Info, error) {
+	if module.builtin {
+		return nil, fmt.Errorf("Kmod: built-in module %s has no on-disk file to sign", module.name)
+	}
+
+	entry, ok := module.kmod.byName[module.name]
+	if !ok {
+		return nil, fmt.Errorf("Kmod: no on-disk file for module %s", module.name)
+	}
+
+	image, err := readModuleImage(entry.path, module.kmod.decompressor)
+	if err != nil {
+		return nil, err
+	}
+	return signature.Parse(image)
+}
+
+// readModuleImage returns the raw, uncompressed bytes of the .ko file
+// at path.
+func readModuleImage(path string, decompressor func(path string) ([]byte, error)) ([]byte, error) {
+	if isCompressedPath(path) {
+		return decompressor(path)
+	}
+	return os.ReadFile(path)
+}
+
+func readModinfoSection(path string, decompressor func(path string) ([]byte, error)) (map[string]string, error) {
+	var r io.ReaderAt
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if isCompressedPath(path) {
+		image, err := decompressor(path)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(image)
+	} else {
+		r = f
+	}
+
+	ef, err := elf.NewFile(r)
+	if err != nil {
+		return nil, err
+	}
+	defer ef.Close()
+
+	section := ef.Section(".modinfo")
+	if section == nil {
+		return nil, fmt.Errorf("Kmod: no .modinfo section in %s", path)
+	}
+	data, err := section.Data()
+	if err != nil {
+		return nil, err
+	}
+
+	info := map[string]string{}
+	for _, field := range bytes.Split(data, []byte{0}) {
+		if len(field) == 0 {
+			continue
+		}
+		key, value, ok := strings.Cut(string(field), "=")
+		if !ok {
+			continue
+		}
+		info[key] = value
+	}
+	return info, nil
+}
@@ -0,0 +1,208 @@
+// Copyright 2017 Tristan Claverie. All rights reserved.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+//go:build purego
+// +build purego
+
+package kmod
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestModuleName(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/lib/modules/6.1.0/kernel/drivers/input/pcspkr.ko", "pcspkr"},
+		{"pcspkr.ko.gz", "pcspkr"},
+		{"pcspkr.ko.xz", "pcspkr"},
+		{"pcspkr.ko.zst", "pcspkr"},
+		{"snd-hda-intel.ko", "snd_hda_intel"},
+		{"no-suffix", "no_suffix"},
+	}
+	for _, tt := range tests {
+		if got := moduleName(tt.path); got != tt.want {
+			t.Errorf("moduleName(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+// writeFixture writes modules.dep and modules.alias under a temp
+// module directory and returns it.
+func writeFixture(t *testing.T, dep, alias string) string {
+	t.Helper()
+	dir := t.TempDir()
+	if dep != "" {
+		if err := os.WriteFile(filepath.Join(dir, "modules.dep"), []byte(dep), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if alias != "" {
+		if err := os.WriteFile(filepath.Join(dir, "modules.alias"), []byte(alias), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestLoadDep(t *testing.T) {
+	dir := writeFixture(t, "/lib/modules/6.1.0/foo.ko: /lib/modules/6.1.0/bar.ko\n/lib/modules/6.1.0/bar.ko:\n", "")
+
+	kmod := &Kmod{moduleDir: dir, byName: map[string]*depEntry{}}
+	if err := kmod.loadDep(); err != nil {
+		t.Fatalf("loadDep: %s", err)
+	}
+
+	foo, ok := kmod.byName["foo"]
+	if !ok {
+		t.Fatalf("byName[foo] missing, got %v", kmod.byName)
+	}
+	if want := []string{"/lib/modules/6.1.0/bar.ko"}; !reflect.DeepEqual(foo.deps, want) {
+		t.Errorf("foo.deps = %v, want %v", foo.deps, want)
+	}
+	if _, ok := kmod.byName["bar"]; !ok {
+		t.Errorf("byName[bar] missing, got %v", kmod.byName)
+	}
+}
+
+func TestLoadAlias(t *testing.T) {
+	dir := writeFixture(t, "", "alias snd-card-0 snd_hda_intel\nnot-an-alias-line\n")
+
+	kmod := &Kmod{moduleDir: dir}
+	if err := kmod.loadAlias(); err != nil {
+		t.Fatalf("loadAlias: %s", err)
+	}
+
+	want := []aliasEntry{{pattern: "snd-card-0", module: "snd_hda_intel"}}
+	if !reflect.DeepEqual(kmod.alias, want) {
+		t.Errorf("alias = %v, want %v", kmod.alias, want)
+	}
+}
+
+func TestLoadAlias_Missing(t *testing.T) {
+	dir := writeFixture(t, "", "")
+
+	kmod := &Kmod{moduleDir: dir}
+	if err := kmod.loadAlias(); err != nil {
+		t.Fatalf("loadAlias: want nil error for a missing modules.alias, got %s", err)
+	}
+}
+
+// newTestKmod builds a Kmod whose dependency graph is:
+//
+//	leaf (builtin, no entry)
+//	bar  -> leaf
+//	foo  -> bar, baz
+//	baz  -> bar
+//
+// and whose modules.alias resolves "alias-for-foo" to foo.
+func newTestKmod() *Kmod {
+	return &Kmod{
+		byName: map[string]*depEntry{
+			"foo": {path: "foo.ko", deps: []string{"bar.ko", "baz.ko"}},
+			"bar": {path: "bar.ko", deps: []string{"leaf.ko"}},
+			"baz": {path: "baz.ko", deps: []string{"bar.ko"}},
+		},
+		builtin: map[string]bool{"leaf": true},
+		alias:   []aliasEntry{{pattern: "alias-for-foo", module: "foo"}},
+	}
+}
+
+func TestResolveInsertOrder(t *testing.T) {
+	kmod := newTestKmod()
+
+	order, err := kmod.resolveInsertOrder("foo")
+	if err != nil {
+		t.Fatalf("resolveInsertOrder: %s", err)
+	}
+
+	var names []string
+	for _, entry := range order {
+		names = append(names, moduleName(entry.path))
+	}
+
+	pos := map[string]int{}
+	for i, n := range names {
+		pos[n] = i
+	}
+	if _, ok := pos["bar"]; !ok {
+		t.Fatalf("resolveInsertOrder(foo) = %v, missing dependency bar", names)
+	}
+	if pos["bar"] >= pos["foo"] {
+		t.Errorf("resolveInsertOrder(foo) = %v, want bar loaded before foo", names)
+	}
+	if pos["baz"] >= pos["foo"] {
+		t.Errorf("resolveInsertOrder(foo) = %v, want baz loaded before foo", names)
+	}
+	// bar is a shared dependency of foo and baz; the dedup in
+	// resolveInsertOrder must only emit it once.
+	count := 0
+	for _, n := range names {
+		if n == "bar" {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Errorf("resolveInsertOrder(foo) lists bar %d times, want 1", count)
+	}
+}
+
+func TestResolveInsertOrder_BuiltinDependencyIsSkipped(t *testing.T) {
+	kmod := newTestKmod()
+
+	order, err := kmod.resolveInsertOrder("bar")
+	if err != nil {
+		t.Fatalf("resolveInsertOrder: %s", err)
+	}
+	// leaf is built-in, so it has no depEntry and must not appear in
+	// the plan, only bar itself.
+	if len(order) != 1 || moduleName(order[0].path) != "bar" {
+		t.Errorf("resolveInsertOrder(bar) = %v, want just [bar]", order)
+	}
+}
+
+func TestResolveInsertOrder_MissingModule(t *testing.T) {
+	kmod := newTestKmod()
+
+	if _, err := kmod.resolveInsertOrder("does-not-exist"); err == nil {
+		t.Fatal("resolveInsertOrder: want error for an unresolvable module, got nil")
+	}
+}
+
+func TestResolveInsertOrder_Alias(t *testing.T) {
+	kmod := newTestKmod()
+
+	order, err := kmod.resolveInsertOrder("alias-for-foo")
+	if err != nil {
+		t.Fatalf("resolveInsertOrder: %s", err)
+	}
+	if len(order) == 0 || moduleName(order[len(order)-1].path) != "foo" {
+		t.Errorf("resolveInsertOrder(alias-for-foo) = %v, want foo last", order)
+	}
+}
+
+func TestResolveInsertOrder_Cycle(t *testing.T) {
+	kmod := &Kmod{
+		byName: map[string]*depEntry{
+			"a": {path: "a.ko", deps: []string{"b.ko"}},
+			"b": {path: "b.ko", deps: []string{"a.ko"}},
+		},
+		builtin: map[string]bool{},
+	}
+
+	// resolveInsertOrder's seen-set must keep a dependency cycle from
+	// recursing forever, and still list each module of the cycle once.
+	order, err := kmod.resolveInsertOrder("a")
+	if err != nil {
+		t.Fatalf("resolveInsertOrder: %s", err)
+	}
+	if len(order) != 2 {
+		t.Errorf("resolveInsertOrder(a) = %v, want both a and b exactly once", order)
+	}
+}
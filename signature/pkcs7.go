@@ -0,0 +1,81 @@
+// Copyright 2017 Tristan Claverie. All rights reserved.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package signature
+
+import (
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+)
+
+// contentInfo is the outer PKCS#7 envelope (RFC 2315 §7): a content
+// type OID and, for signedData, the SignedData itself.
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,tag:0"`
+}
+
+// signedDataOID identifies the PKCS#7 signedData content type that
+// sign-file always produces.
+var signedDataOID = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+
+// signedData mirrors PKCS#7's SignedData (RFC 2315 §9.1). Certificates
+// and CRLs are left as raw DER: certificates is parsed separately with
+// x509.ParseCertificates, since each element is already a standard
+// X.509 Certificate and Go's asn1 package has no generic support for
+// an implicitly-tagged SET OF.
+type signedData struct {
+	Version          int
+	DigestAlgorithms asn1.RawValue
+	ContentInfo      asn1.RawValue
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue `asn1:"optional,tag:1"`
+	SignerInfos      []signerInfo  `asn1:"set"`
+}
+
+// algorithmIdentifier mirrors X.509's AlgorithmIdentifier.
+type algorithmIdentifier struct {
+	Algorithm  asn1.ObjectIdentifier
+	Parameters asn1.RawValue `asn1:"optional"`
+}
+
+// issuerAndSerial mirrors PKCS#7's IssuerAndSerialNumber, used to pick
+// out which embedded certificate produced a given signerInfo.
+type issuerAndSerial struct {
+	Issuer asn1.RawValue
+	Serial *big.Int
+}
+
+// signerInfo mirrors PKCS#7's SignerInfo (RFC 2315 §9.2). sign-file
+// builds it with CMS_NOATTR, so AuthenticatedAttributes is normally
+// absent and EncryptedDigest signs the module content directly; see
+// verify.
+type signerInfo struct {
+	Version                   int
+	IssuerAndSerialNumber     issuerAndSerial
+	DigestAlgorithm           algorithmIdentifier
+	AuthenticatedAttributes   asn1.RawValue `asn1:"optional,tag:0"`
+	DigestEncryptionAlgorithm algorithmIdentifier
+	EncryptedDigest           []byte
+	UnauthenticatedAttributes asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+// parsePKCS7 decodes a BER/DER-encoded PKCS#7 ContentInfo wrapping a
+// SignedData, the format sign-file appends to signed modules.
+func parsePKCS7(der []byte) (*signedData, error) {
+	var ci contentInfo
+	if _, err := asn1.Unmarshal(der, &ci); err != nil {
+		return nil, err
+	}
+	if !ci.ContentType.Equal(signedDataOID) {
+		return nil, fmt.Errorf("unexpected PKCS#7 content type %s, want signedData", ci.ContentType)
+	}
+
+	var sd signedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return nil, err
+	}
+	return &sd, nil
+}
@@ -0,0 +1,51 @@
+// Copyright 2017 Tristan Claverie. All rights reserved.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package signature
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// procKeysPath is where the running kernel lists the keys in its
+// keyrings, including the ones module signing checks modules against.
+const procKeysPath = "/proc/keys"
+
+// CrossCheckProcKeys reports whether a key matching info's KeyID is
+// present in /proc/keys, the kernel's view of its own trusted keyrings.
+// A match only means the kernel holds a key with this identifier - it
+// is not a cryptographic verification, since /proc/keys never exposes
+// key material; use VerifyKeyring for that when you have the
+// certificates yourself.
+func (info *Info) CrossCheckProcKeys() (bool, error) {
+	return crossCheckProcKeys(procKeysPath, info.KeyIDString())
+}
+
+func crossCheckProcKeys(path, keyID string) (bool, error) {
+	if keyID == "" {
+		return false, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return false, fmt.Errorf("signature: %s", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Each line looks like:
+		// 3cbf01f2 I--Q---     1 perm 1f030000     0     0 asymmetri modsign-only.0: ... <keyID>
+		// The fields we care about are free-form text at the end of
+		// the line, so a substring match on the key identifier is the
+		// same approach modprobe's sources use.
+		if strings.Contains(scanner.Text(), keyID) {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
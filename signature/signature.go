@@ -0,0 +1,181 @@
+// Copyright 2017 Tristan Claverie. All rights reserved.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+// Package signature parses the PKCS#7 signature block the kernel's
+// sign-file tool appends to signed kernel modules, and offers a
+// best-effort way to check it.
+//
+// A signed module image ends with, in order: the signer name, the key
+// identifier, the raw PKCS#7 (CMS) SignedData, a fixed-size
+// struct module_signature footer, and the marker
+// "~Module signature appended~\n". See the kernel's
+// include/linux/module_signature.h and scripts/sign-file.c.
+package signature
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// ErrNotSigned is returned by Parse when image carries no
+// "~Module signature appended~\n" marker at all.
+var ErrNotSigned = errors.New("signature: module is not signed")
+
+// Info describes the signature appended to a module image.
+type Info struct {
+	// Signer is the subject common name of the certificate that
+	// produced the signature, if that certificate is embedded in the
+	// PKCS#7 block. It is empty when the module only carries a key
+	// identifier and the verifier is expected to already hold the
+	// certificate.
+	Signer string
+
+	// KeyID identifies the signing key: the key identifier the kernel
+	// embedded alongside the signature if sign-file was given one, or
+	// otherwise the embedded certificate's subject key identifier.
+	KeyID []byte
+
+	// HashAlgorithm names the digest algorithm the signature was
+	// computed over, e.g. "SHA256". It is empty if the OID in the
+	// PKCS#7 block is not recognized.
+	HashAlgorithm string
+
+	// Certificates holds every X.509 certificate embedded in the
+	// PKCS#7 block. sign-file normally embeds exactly one, the
+	// self-signed certificate matching the module-signing private key.
+	Certificates []*x509.Certificate
+
+	// Raw is the undecoded PKCS#7 SignedData, in case a caller needs
+	// to hand it to another ASN.1/CMS implementation.
+	Raw []byte
+
+	// Verified reports whether the embedded certificate's public key
+	// cryptographically verifies the signature over the module's
+	// content. It says nothing about whether that certificate is
+	// trusted - see VerifyKeyring to check it against a keyring.
+	Verified bool
+
+	content []byte
+	sig     *signerInfo
+}
+
+// Parse locates and decodes the PKCS#7 signature block appended to a
+// module image, the raw bytes of a .ko file after any decompression.
+// It returns ErrNotSigned if image has no signature marker.
+func Parse(image []byte) (*Info, error) {
+	content, signer, keyID, sigData, t, err := splitTrailer(image)
+	if err != nil {
+		return nil, err
+	}
+	if t.idType != PKCS7 {
+		return nil, fmt.Errorf("signature: unsupported key identifier type %d, only PKCS#7 is supported", t.idType)
+	}
+
+	sd, err := parsePKCS7(sigData)
+	if err != nil {
+		return nil, fmt.Errorf("signature: %s", err)
+	}
+	if len(sd.SignerInfos) == 0 {
+		return nil, fmt.Errorf("signature: PKCS#7 block carries no signer information")
+	}
+	si := &sd.SignerInfos[0]
+
+	certs, err := parseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("signature: %s", err)
+	}
+
+	info := &Info{
+		KeyID:         keyID,
+		HashAlgorithm: hashName(si.DigestAlgorithm.Algorithm),
+		Certificates:  certs,
+		Raw:           sigData,
+		content:       content,
+		sig:           si,
+	}
+	if len(keyID) == 0 && len(signer) == 0 {
+		// Modern sign-file output carries no signer/key_id in the
+		// trailer at all; everything needed is inside the PKCS#7
+		// block itself.
+		if cert := signerCertificate(certs, si); cert != nil {
+			info.Signer = cert.Subject.CommonName
+			if len(cert.SubjectKeyId) > 0 {
+				info.KeyID = cert.SubjectKeyId
+			}
+		}
+	} else {
+		info.Signer = string(signer)
+	}
+
+	if cert := signerCertificate(certs, si); cert != nil {
+		ok, err := verify(content, si, cert)
+		if err == nil {
+			info.Verified = ok
+		}
+	}
+
+	return info, nil
+}
+
+// VerifyKeyring re-checks the signature against the certificates in
+// keyring instead of whichever certificate Parse found embedded in the
+// PKCS#7 block, the way the kernel checks a module against its own
+// trusted keyring rather than a certificate the module itself supplied.
+// It returns the matching certificate and whether the signature checks
+// out against it, or a nil certificate if none in keyring matches the
+// signer identified by the signature.
+func (info *Info) VerifyKeyring(keyring []*x509.Certificate) (*x509.Certificate, bool, error) {
+	cert := matchingCertificate(keyring, info.sig)
+	if cert == nil {
+		return nil, false, nil
+	}
+	ok, err := verify(info.content, info.sig, cert)
+	return cert, ok, err
+}
+
+// signerCertificate returns matchingCertificate(certs, si), or the sole
+// certificate in certs if there is exactly one and no match was found -
+// sign-file only ever embeds the one certificate that produced the
+// signature.
+func signerCertificate(certs []*x509.Certificate, si *signerInfo) *x509.Certificate {
+	if cert := matchingCertificate(certs, si); cert != nil {
+		return cert
+	}
+	if len(certs) == 1 {
+		return certs[0]
+	}
+	return nil
+}
+
+// matchingCertificate returns the certificate among certs whose issuer
+// and serial number match si's IssuerAndSerialNumber, or nil.
+func matchingCertificate(certs []*x509.Certificate, si *signerInfo) *x509.Certificate {
+	if si == nil {
+		return nil
+	}
+	for _, cert := range certs {
+		if cert.SerialNumber != nil && si.IssuerAndSerialNumber.Serial != nil &&
+			cert.SerialNumber.Cmp(si.IssuerAndSerialNumber.Serial) == 0 &&
+			bytes.Equal(cert.RawIssuer, si.IssuerAndSerialNumber.Issuer.FullBytes) {
+			return cert
+		}
+	}
+	return nil
+}
+
+// KeyIDString returns KeyID formatted the way /proc/keys prints key
+// identifiers, for matching Info against CrossCheckProcKeys.
+func (info *Info) KeyIDString() string {
+	return hex.EncodeToString(info.KeyID)
+}
+
+func parseCertificates(der []byte) ([]*x509.Certificate, error) {
+	if len(der) == 0 {
+		return nil, nil
+	}
+	return x509.ParseCertificates(der)
+}
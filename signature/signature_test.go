@@ -0,0 +1,173 @@
+// Copyright 2017 Tristan Claverie. All rights reserved.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package signature
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// dataOID is PKCS#7's "data" content type, used as the (unread) inner
+// eContentType of the synthetic SignedData built below.
+var dataOID = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+
+var digestAlgSHA256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+var rsaEncryptionOID = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+
+// buildSignedImage produces a module image carrying a real, verifiable
+// PKCS#7 signature over content, the way sign-file's output would
+// decode under this package, so Parse can be exercised without a real
+// signed .ko file on disk.
+func buildSignedImage(t *testing.T, content []byte) (image []byte, cert *x509.Certificate) {
+	t.Helper()
+
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey: %s", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test-signer"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %s", err)
+	}
+	cert, err = x509.ParseCertificate(certDER)
+	if err != nil {
+		t.Fatalf("ParseCertificate: %s", err)
+	}
+
+	hash := sha256.Sum256(content)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, priv, crypto.SHA256, hash[:])
+	if err != nil {
+		t.Fatalf("SignPKCS1v15: %s", err)
+	}
+
+	si := signerInfo{
+		Version: 1,
+		IssuerAndSerialNumber: issuerAndSerial{
+			Issuer: asn1.RawValue{FullBytes: cert.RawIssuer},
+			Serial: cert.SerialNumber,
+		},
+		DigestAlgorithm:           algorithmIdentifier{Algorithm: digestAlgSHA256},
+		DigestEncryptionAlgorithm: algorithmIdentifier{Algorithm: rsaEncryptionOID},
+		EncryptedDigest:           sig,
+	}
+
+	digestAlgorithms, err := asn1.MarshalWithParams([]algorithmIdentifier{{Algorithm: digestAlgSHA256}}, "set")
+	if err != nil {
+		t.Fatalf("marshal digestAlgorithms: %s", err)
+	}
+
+	innerContentInfo, err := asn1.Marshal(struct{ ContentType asn1.ObjectIdentifier }{dataOID})
+	if err != nil {
+		t.Fatalf("marshal inner ContentInfo: %s", err)
+	}
+
+	certsBytes, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: cert.Raw})
+	if err != nil {
+		t.Fatalf("marshal Certificates: %s", err)
+	}
+
+	sd := signedData{
+		Version:          1,
+		DigestAlgorithms: asn1.RawValue{FullBytes: digestAlgorithms},
+		ContentInfo:      asn1.RawValue{FullBytes: innerContentInfo},
+		Certificates:     asn1.RawValue{FullBytes: certsBytes},
+		SignerInfos:      []signerInfo{si},
+	}
+	sdBytes, err := asn1.Marshal(sd)
+	if err != nil {
+		t.Fatalf("marshal signedData: %s", err)
+	}
+
+	wrappedContent, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: sdBytes})
+	if err != nil {
+		t.Fatalf("marshal explicit content: %s", err)
+	}
+	sigData, err := asn1.Marshal(contentInfo{
+		ContentType: signedDataOID,
+		Content:     asn1.RawValue{FullBytes: wrappedContent},
+	})
+	if err != nil {
+		t.Fatalf("marshal ContentInfo: %s", err)
+	}
+
+	signer := []byte(cert.Subject.CommonName)
+	keyID := cert.SubjectKeyId
+
+	raw := make([]byte, trailerSize)
+	raw[2] = PKCS7
+	raw[3] = byte(len(signer))
+	raw[4] = byte(len(keyID))
+	binary.BigEndian.PutUint32(raw[8:12], uint32(len(sigData)))
+
+	image = append(image, content...)
+	image = append(image, signer...)
+	image = append(image, keyID...)
+	image = append(image, sigData...)
+	image = append(image, raw...)
+	image = append(image, []byte(marker)...)
+	return image, cert
+}
+
+func TestParse(t *testing.T) {
+	content := []byte("fake module content")
+	image, cert := buildSignedImage(t, content)
+
+	info, err := Parse(image)
+	if err != nil {
+		t.Fatalf("Parse: %s", err)
+	}
+	if info.Signer != cert.Subject.CommonName {
+		t.Errorf("Signer = %q, want %q", info.Signer, cert.Subject.CommonName)
+	}
+	if info.HashAlgorithm != "SHA256" {
+		t.Errorf("HashAlgorithm = %q, want SHA256", info.HashAlgorithm)
+	}
+	if len(info.Certificates) != 1 {
+		t.Fatalf("len(Certificates) = %d, want 1", len(info.Certificates))
+	}
+	if !info.Verified {
+		t.Error("Verified = false, want true for a correctly signed image")
+	}
+}
+
+func TestParse_NotSigned(t *testing.T) {
+	_, err := Parse([]byte("not a signed module"))
+	if err != ErrNotSigned {
+		t.Fatalf("err = %v, want ErrNotSigned", err)
+	}
+}
+
+func TestParse_TamperedContent(t *testing.T) {
+	content := []byte("fake module content")
+	image, _ := buildSignedImage(t, content)
+
+	// Flip a byte inside the signed content without touching the
+	// trailer, so the signature no longer matches.
+	image[0] ^= 0xff
+
+	info, err := Parse(image)
+	if err != nil {
+		t.Fatalf("Parse: %s", err)
+	}
+	if info.Verified {
+		t.Error("Verified = true for a tampered image, want false")
+	}
+}
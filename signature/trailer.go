@@ -0,0 +1,75 @@
+// Copyright 2017 Tristan Claverie. All rights reserved.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package signature
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// marker is the string the kernel looks for at the end of a signed
+// module image; see MODULE_SIG_STRING in the kernel's
+// include/linux/module_signature.h.
+const marker = "~Module signature appended~\n"
+
+// PKCS7 is the id_type struct module_signature carries when the
+// appended signature is a PKCS#7 (CMS) SignedData blob - the only
+// format modern kernels and sign-file produce. See PKEY_ID_PKCS7.
+const PKCS7 = 2
+
+// trailerSize is sizeof(struct module_signature): five one-byte
+// fields, three bytes of padding, then a big-endian uint32 holding the
+// length of the signature data.
+const trailerSize = 12
+
+// trailer mirrors the kernel's struct module_signature, the fixed-size
+// footer that immediately precedes marker.
+type trailer struct {
+	algo      uint8
+	hash      uint8
+	idType    uint8
+	signerLen uint8
+	keyIDLen  uint8
+	sigLen    uint32
+}
+
+// splitTrailer locates the signature block sign-file(1) appends to
+// image and splits it into the unsigned module content and the raw
+// signer name, key identifier and signature payload that follow it. It
+// returns ErrNotSigned if image carries no signature marker.
+func splitTrailer(image []byte) (content, signer, keyID, sig []byte, t trailer, err error) {
+	if len(image) < len(marker) || !bytes.HasSuffix(image, []byte(marker)) {
+		return nil, nil, nil, nil, trailer{}, ErrNotSigned
+	}
+	rest := image[:len(image)-len(marker)]
+
+	if len(rest) < trailerSize {
+		return nil, nil, nil, nil, trailer{}, fmt.Errorf("signature: truncated module_signature trailer")
+	}
+	raw := rest[len(rest)-trailerSize:]
+	rest = rest[:len(rest)-trailerSize]
+
+	t = trailer{
+		algo:      raw[0],
+		hash:      raw[1],
+		idType:    raw[2],
+		signerLen: raw[3],
+		keyIDLen:  raw[4],
+		sigLen:    binary.BigEndian.Uint32(raw[8:12]),
+	}
+
+	total := int(t.signerLen) + int(t.keyIDLen) + int(t.sigLen)
+	if total > len(rest) {
+		return nil, nil, nil, nil, trailer{}, fmt.Errorf("signature: signature block longer than the module image")
+	}
+
+	content = rest[:len(rest)-total]
+	tail := rest[len(rest)-total:]
+	signer = tail[:t.signerLen]
+	keyID = tail[t.signerLen : t.signerLen+t.keyIDLen]
+	sig = tail[t.signerLen+t.keyIDLen:]
+	return content, signer, keyID, sig, t, nil
+}
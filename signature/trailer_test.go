@@ -0,0 +1,103 @@
+// Copyright 2017 Tristan Claverie. All rights reserved.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package signature
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// buildTrailer assembles a module_signature trailer and marker the way
+// sign-file appends them, so splitTrailer can be exercised without a
+// real signed .ko file.
+func buildTrailer(content, signer, keyID, sig []byte) []byte {
+	raw := make([]byte, trailerSize)
+	raw[2] = PKCS7
+	raw[3] = byte(len(signer))
+	raw[4] = byte(len(keyID))
+	binary.BigEndian.PutUint32(raw[8:12], uint32(len(sig)))
+
+	var image []byte
+	image = append(image, content...)
+	image = append(image, signer...)
+	image = append(image, keyID...)
+	image = append(image, sig...)
+	image = append(image, raw...)
+	image = append(image, []byte(marker)...)
+	return image
+}
+
+func TestSplitTrailer(t *testing.T) {
+	content := []byte("fake module content")
+	signer := []byte("test-signer")
+	keyID := []byte{0x01, 0x02, 0x03, 0x04}
+	sig := []byte("fake-signature-bytes")
+
+	t.Run("valid", func(t *testing.T) {
+		image := buildTrailer(content, signer, keyID, sig)
+
+		gotContent, gotSigner, gotKeyID, gotSig, tr, err := splitTrailer(image)
+		if err != nil {
+			t.Fatalf("splitTrailer: %s", err)
+		}
+		if !bytes.Equal(gotContent, content) {
+			t.Errorf("content = %q, want %q", gotContent, content)
+		}
+		if !bytes.Equal(gotSigner, signer) {
+			t.Errorf("signer = %q, want %q", gotSigner, signer)
+		}
+		if !bytes.Equal(gotKeyID, keyID) {
+			t.Errorf("keyID = %x, want %x", gotKeyID, keyID)
+		}
+		if !bytes.Equal(gotSig, sig) {
+			t.Errorf("sig = %q, want %q", gotSig, sig)
+		}
+		if tr.idType != PKCS7 {
+			t.Errorf("idType = %d, want %d", tr.idType, PKCS7)
+		}
+	})
+
+	t.Run("no marker", func(t *testing.T) {
+		image := buildTrailer(content, signer, keyID, sig)
+		image = image[:len(image)-1] // corrupt the trailing marker byte
+		_, _, _, _, _, err := splitTrailer(image)
+		if !errors.Is(err, ErrNotSigned) {
+			t.Fatalf("err = %v, want ErrNotSigned", err)
+		}
+	})
+
+	t.Run("shorter than marker", func(t *testing.T) {
+		_, _, _, _, _, err := splitTrailer([]byte("short"))
+		if !errors.Is(err, ErrNotSigned) {
+			t.Fatalf("err = %v, want ErrNotSigned", err)
+		}
+	})
+
+	t.Run("truncated trailer", func(t *testing.T) {
+		image := buildTrailer(content, signer, keyID, sig)
+		// Keep only the first few bytes of the image ahead of the
+		// marker, so less than trailerSize remains ahead of it.
+		image = append(image[:3], []byte(marker)...)
+		_, _, _, _, _, err := splitTrailer(image)
+		if err == nil {
+			t.Fatal("splitTrailer: want error for a truncated trailer, got nil")
+		}
+	})
+
+	t.Run("oversized sigLen", func(t *testing.T) {
+		image := buildTrailer(content, signer, keyID, sig)
+		// The sigLen field is the last 4 bytes ahead of the marker;
+		// inflate it far past what the image actually carries.
+		trailerStart := len(image) - len(marker) - trailerSize
+		binary.BigEndian.PutUint32(image[trailerStart+8:trailerStart+12], 0xffffff)
+
+		_, _, _, _, _, err := splitTrailer(image)
+		if err == nil {
+			t.Fatal("splitTrailer: want error for an oversized sigLen, got nil")
+		}
+	})
+}
@@ -0,0 +1,92 @@
+// Copyright 2017 Tristan Claverie. All rights reserved.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package signature
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+)
+
+// digestOIDs maps the digest algorithm OIDs sign-file may record in a
+// SignerInfo to their crypto.Hash and display name. Kernel modules are
+// realistically only ever signed with one of the SHA-2 family.
+var digestOIDs = map[string]struct {
+	hash crypto.Hash
+	name string
+}{
+	"1.3.14.3.2.26":          {crypto.SHA1, "SHA1"},
+	"2.16.840.1.101.3.4.2.1": {crypto.SHA256, "SHA256"},
+	"2.16.840.1.101.3.4.2.2": {crypto.SHA384, "SHA384"},
+	"2.16.840.1.101.3.4.2.3": {crypto.SHA512, "SHA512"},
+	"2.16.840.1.101.3.4.2.4": {crypto.SHA224, "SHA224"},
+}
+
+func hashName(oid asn1.ObjectIdentifier) string {
+	if d, ok := digestOIDs[oid.String()]; ok {
+		return d.name
+	}
+	return ""
+}
+
+// signatureAlgorithm picks the x509.SignatureAlgorithm matching hash
+// under the signer certificate's public key algorithm, the combination
+// cert.CheckSignature needs to verify a bare PKCS#7 signature that
+// carries no signatureAlgorithm OID of its own.
+func signatureAlgorithm(pub x509.PublicKeyAlgorithm, hash crypto.Hash) x509.SignatureAlgorithm {
+	switch pub {
+	case x509.RSA:
+		switch hash {
+		case crypto.SHA256:
+			return x509.SHA256WithRSA
+		case crypto.SHA384:
+			return x509.SHA384WithRSA
+		case crypto.SHA512:
+			return x509.SHA512WithRSA
+		case crypto.SHA1:
+			return x509.SHA1WithRSA
+		}
+	case x509.ECDSA:
+		switch hash {
+		case crypto.SHA256:
+			return x509.ECDSAWithSHA256
+		case crypto.SHA384:
+			return x509.ECDSAWithSHA384
+		case crypto.SHA512:
+			return x509.ECDSAWithSHA512
+		case crypto.SHA1:
+			return x509.ECDSAWithSHA1
+		}
+	}
+	return x509.UnknownSignatureAlgorithm
+}
+
+// verify checks si.EncryptedDigest against content using cert's public
+// key. sign-file builds its PKCS#7 block with CMS_NOATTR, so
+// EncryptedDigest signs content directly rather than a set of
+// authenticated attributes; a signerInfo carrying
+// AuthenticatedAttributes - as a non-kernel PKCS#7 producer might write
+// - is reported unverified rather than misinterpreted.
+func verify(content []byte, si *signerInfo, cert *x509.Certificate) (bool, error) {
+	if len(si.AuthenticatedAttributes.Bytes) > 0 {
+		return false, fmt.Errorf("signature: signed authenticated attributes are not supported")
+	}
+
+	d, ok := digestOIDs[si.DigestAlgorithm.Algorithm.String()]
+	if !ok {
+		return false, fmt.Errorf("signature: unsupported digest algorithm %s", si.DigestAlgorithm.Algorithm)
+	}
+
+	algo := signatureAlgorithm(cert.PublicKeyAlgorithm, d.hash)
+	if algo == x509.UnknownSignatureAlgorithm {
+		return false, fmt.Errorf("signature: unsupported public key algorithm %s", cert.PublicKeyAlgorithm)
+	}
+
+	if err := cert.CheckSignature(algo, content, si.EncryptedDigest); err != nil {
+		return false, nil
+	}
+	return true, nil
+}